@@ -3,6 +3,7 @@ package controller
 import (
 	"context"
 	"fmt"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	goGitlab "github.com/xanzy/go-gitlab"
@@ -33,15 +34,68 @@ func (c *Controller) PullRefMetrics(ctx context.Context, ref schemas.Ref) error
 		refName = ref.Name
 	}
 
-	pipelines, _, err := c.Gitlab.GetProjectPipelines(ctx, ref.Project.Name, &goGitlab.ListProjectPipelinesOptions{
-		ListOptions: goGitlab.ListOptions{
-			PerPage: int(ref.Project.Pull.Pipeline.PerRef),
-			Page:    1,
-		},
-		Ref: &refName,
-	})
-	if err != nil {
-		return fmt.Errorf("error fetching project pipelines for %s: %v", ref.Project.Name, err)
+	var pipelines []*goGitlab.PipelineInfo
+
+	if after, before, ok := ref.Project.Pull.Pipeline.Window.Bounds(); ok {
+		// A window may span far more pipelines than `PerRef`, so page through it in full
+		// (oldest first, same as `BackfillRefMetrics`) rather than capping at a single page --
+		// otherwise pipelines outside the first page are silently dropped.
+		//
+		// On a scheduled (non-backfill) pull this would otherwise re-walk the entire
+		// window on every scrape, multiplying API calls by window size x scrape
+		// frequency. Narrow the lower bound to the last pipeline we've already
+		// processed for this ref, since `BackfillRefMetrics` is what warms the full
+		// window on startup.
+		if ref.LatestPipeline.ID != 0 && ref.LatestPipeline.Timestamp > 0 {
+			lastSeen := time.Unix(int64(ref.LatestPipeline.Timestamp), 0)
+			if after == nil || lastSeen.After(*after) {
+				after = &lastSeen
+			}
+		}
+
+		page := 1
+
+		for {
+			pagePipelines, resp, err := c.Gitlab.GetProjectPipelines(ctx, ref.Project.Name, &goGitlab.ListProjectPipelinesOptions{
+				ListOptions: goGitlab.ListOptions{
+					PerPage: int(ref.Project.Pull.Pipeline.PerRef),
+					Page:    page,
+				},
+				Ref:           &refName,
+				CreatedAfter:  after,
+				CreatedBefore: before,
+				OrderBy:       goGitlab.Ptr("id"),
+				Sort:          goGitlab.Ptr("asc"),
+			})
+			if err != nil {
+				return fmt.Errorf("error fetching project pipelines for %s: %v", ref.Project.Name, err)
+			}
+
+			pipelines = append(pipelines, pagePipelines...)
+
+			if resp == nil || resp.NextPage == 0 {
+				break
+			}
+
+			page = resp.NextPage
+		}
+	} else {
+		var err error
+
+		pipelines, _, err = c.Gitlab.GetProjectPipelines(ctx, ref.Project.Name, &goGitlab.ListProjectPipelinesOptions{
+			ListOptions: goGitlab.ListOptions{
+				PerPage: int(ref.Project.Pull.Pipeline.PerRef),
+				Page:    1,
+			},
+			Ref: &refName,
+		})
+		if err != nil {
+			return fmt.Errorf("error fetching project pipelines for %s: %v", ref.Project.Name, err)
+		}
+
+		// Reverse result list to have `ref`'s `LatestPipeline` untouched (compared to
+		// default behavior) after looping over list
+		slices.Reverse(pipelines)
 	}
 
 	if len(pipelines) == 0 {
@@ -50,10 +104,6 @@ func (c *Controller) PullRefMetrics(ctx context.Context, ref schemas.Ref) error
 		return nil
 	}
 
-	// Reverse result list to have `ref`'s `LatestPipeline` untouched (compared to
-	// default behavior) after looping over list
-	slices.Reverse(pipelines)
-
 	for _, apiPipeline := range pipelines {
 		err := c.ProcessPipelinesMetrics(ctx, ref, apiPipeline)
 		if err != nil {
@@ -67,6 +117,75 @@ func (c *Controller) PullRefMetrics(ctx context.Context, ref schemas.Ref) error
 	return nil
 }
 
+// BackfillRefMetrics pages back through a ref's pipelines, oldest first, until the
+// [from, to] window has been fully walked rather than stopping at `PerRef`. It is meant
+// to be invoked once (e.g. on startup) to warm the store with historical data for refs
+// where pipelines can land out of order.
+func (c *Controller) BackfillRefMetrics(ctx context.Context, ref schemas.Ref, from, to time.Time) error {
+	if err := c.Store.GetRef(ctx, &ref); err != nil {
+		return err
+	}
+
+	logFields := log.Fields{
+		"project-name": ref.Project.Name,
+		"ref":          ref.Name,
+		"ref-kind":     ref.Kind,
+		"from":         from,
+		"to":           to,
+	}
+
+	var refName string
+	if ref.Kind == schemas.RefKindMergeRequest {
+		refName = fmt.Sprintf("refs/merge-requests/%s/head", ref.Name)
+	} else {
+		refName = ref.Name
+	}
+
+	page := 1
+
+	for {
+		pipelines, resp, err := c.Gitlab.GetProjectPipelines(ctx, ref.Project.Name, &goGitlab.ListProjectPipelinesOptions{
+			ListOptions: goGitlab.ListOptions{
+				PerPage: int(ref.Project.Pull.Pipeline.PerRef),
+				Page:    page,
+			},
+			Ref:           &refName,
+			CreatedAfter:  &from,
+			CreatedBefore: &to,
+			OrderBy:       goGitlab.Ptr("id"),
+			Sort:          goGitlab.Ptr("asc"),
+		})
+		if err != nil {
+			return fmt.Errorf("error fetching project pipelines for %s: %v", ref.Project.Name, err)
+		}
+
+		log.WithFields(logFields).WithField("page", page).Debug("backfilling ref pipelines")
+
+		for _, apiPipeline := range pipelines {
+			if err := c.ProcessPipelinesMetrics(ctx, ref, apiPipeline); err != nil {
+				log.WithFields(log.Fields{
+					"pipeline": apiPipeline.ID,
+					"error":    err,
+				}).Error("processing pipeline metrics failed")
+			}
+		}
+
+		if resp == nil || resp.NextPage == 0 {
+			break
+		}
+
+		page = resp.NextPage
+	}
+
+	return nil
+}
+
+var inProgressStatusesList = []string{
+	"running",
+	"pending",
+	"created",
+}
+
 func (c *Controller) ProcessPipelinesMetrics(ctx context.Context, ref schemas.Ref, apiPipeline *goGitlab.PipelineInfo) error {
 	finishedStatusesList := []string{
 		"success",
@@ -101,6 +220,8 @@ func (c *Controller) ProcessPipelinesMetrics(ctx context.Context, ref schemas.Re
 		Value:  float64(pipeline.ID),
 	}
 
+	previousStatus := ref.LatestPipeline.Status
+
 	// TODO this comparison is a mistake
 	// we should compare the whole pipeline object (as it was before) instead of
 	// just the ID since properties like the status are likely to change
@@ -176,8 +297,51 @@ func (c *Controller) ProcessPipelinesMetrics(ctx context.Context, ref schemas.Re
 				return err
 			}
 		}
+
+		if ref.Project.Pull.Pipeline.ConfigSource.Enabled {
+			// Best-effort: a transient /ci/lint or blob lookup failure (or a missing
+			// permission) shouldn't suppress the core metrics below for this pipeline.
+			if err := c.ProcessPipelineConfigSourceMetrics(ctx, ref, pipeline, formerPipeline.ConfigSource); err != nil {
+				log.WithFields(log.Fields{
+					"project-name": ref.Project.Name,
+					"ref":          ref.Name,
+					"pipeline":     pipeline.ID,
+					"error":        err,
+				}).Warn("resolving pipeline config source failed")
+			}
+		}
 	} else {
-		if err := c.PullRefMostRecentJobsMetrics(ctx, ref); err != nil {
+		// Fetch the jobs once and share them between the retry step below and
+		// PullRefMostRecentJobsMetrics, instead of each pulling them separately on
+		// every scrape.
+		var jobs []*goGitlab.Job
+
+		if ref.Project.Pull.Pipeline.Jobs.Enabled {
+			if jobs, _, err = c.Gitlab.GetRefPipelineJobs(ctx, ref, pipeline); err != nil {
+				return err
+			}
+		}
+
+		// Same pipeline ID but the status may have flipped in place, which is how GitLab
+		// reports a manual "Retry" of an already terminal pipeline/job rather than minting
+		// a brand new pipeline ID.
+		if err := c.ProcessPipelineRetryMetrics(ctx, ref, previousStatus, pipeline, jobs); err != nil {
+			return err
+		}
+
+		// Persist the status we just observed so that the next scrape compares against it
+		// rather than the stale one, otherwise a failed->recovered transition keeps matching
+		// on every subsequent pull and the retry counter never stops incrementing.
+		// The config source is only resolved when a new pipeline ID is seen, so carry the
+		// recorded one over; it is what lets the previous info series be dropped later.
+		pipeline.ConfigSource = ref.LatestPipeline.ConfigSource
+		ref.LatestPipeline = pipeline
+
+		if err := c.Store.SetRef(ctx, ref); err != nil {
+			return err
+		}
+
+		if err := c.PullRefMostRecentJobsMetrics(ctx, ref, jobs); err != nil {
 			return err
 		}
 	}
@@ -202,6 +366,230 @@ func (c *Controller) ProcessPipelinesMetrics(ctx context.Context, ref schemas.Re
 		}
 	}
 
+	if ref.Project.Pull.Pipeline.InProgress.Enabled {
+		if slices.Contains(inProgressStatusesList, ref.LatestPipeline.Status) {
+			if err := c.ProcessInProgressPipelineMetrics(ctx, ref); err != nil {
+				return err
+			}
+		} else if slices.Contains(finishedStatusesList, ref.LatestPipeline.Status) {
+			c.resetInProgressPipelineMetrics(ctx, ref)
+		}
+	}
+
+	return nil
+}
+
+// ProcessInProgressPipelineMetrics emits best-effort progress metrics for a pipeline
+// that has not reached a terminal status yet, then re-schedules itself on the task
+// scheduler so that dashboards can show the pipeline mid-flight rather than only once
+// `ProcessPipelinesMetrics` sees it finished.
+func (c *Controller) ProcessInProgressPipelineMetrics(ctx context.Context, ref schemas.Ref) error {
+	pipeline := ref.LatestPipeline
+	labels := ref.DefaultLabelsValues()
+
+	if !pipeline.StartedAt.IsZero() {
+		storeSetMetric(ctx, c.Store, schemas.Metric{
+			Kind:   schemas.MetricKindInProgressDurationSeconds,
+			Labels: labels,
+			Value:  time.Since(pipeline.StartedAt).Seconds(),
+		})
+	}
+
+	jobs, _, err := c.Gitlab.GetRefPipelineJobs(ctx, ref, pipeline)
+	if err != nil {
+		return err
+	}
+
+	jobStatusCounts := map[string]float64{}
+	for _, job := range jobs {
+		jobStatusCounts[job.Status]++
+	}
+
+	for _, status := range []string{"running", "pending"} {
+		storeSetMetric(ctx, c.Store, schemas.Metric{
+			Kind:   schemas.MetricKindInProgressJobs,
+			Labels: mergeLabels(labels, map[string]string{"status": status}),
+			Value:  jobStatusCounts[status],
+		})
+	}
+
+	refreshInterval := ref.Project.Pull.Pipeline.InProgress.RefreshInterval
+	if refreshInterval <= 0 {
+		refreshInterval = schemas.DefaultPipelineInProgressRefreshInterval
+	}
+
+	c.ScheduleTask(ctx, schemas.TaskTypePullRefMetrics, string(ref.Key()), refreshInterval, ref)
+
+	return nil
+}
+
+// resetInProgressPipelineMetrics zeroes the streaming progress gauges once a pipeline
+// has reached a terminal status, so dashboards stop showing a frozen duration and
+// non-zero running/pending job counts for a pipeline that is no longer in flight.
+func (c *Controller) resetInProgressPipelineMetrics(ctx context.Context, ref schemas.Ref) {
+	labels := ref.DefaultLabelsValues()
+
+	storeSetMetric(ctx, c.Store, schemas.Metric{
+		Kind:   schemas.MetricKindInProgressDurationSeconds,
+		Labels: labels,
+		Value:  0,
+	})
+
+	for _, status := range []string{"running", "pending"} {
+		storeSetMetric(ctx, c.Store, schemas.Metric{
+			Kind:   schemas.MetricKindInProgressJobs,
+			Labels: mergeLabels(labels, map[string]string{"status": status}),
+			Value:  0,
+		})
+	}
+}
+
+// recoveredStatusesList are the statuses a pipeline/job can land on after being retried
+// from one of failedStatusesList.
+var (
+	failedStatusesList    = []string{"failed", "canceled", "cancelled"}
+	recoveredStatusesList = []string{"running", "success"}
+)
+
+// ProcessPipelineRetryMetrics detects a manual retry of an already-processed pipeline --
+// same `pipeline.ID`, but its status flipped from a failed/canceled state back to
+// running/success -- and increments `MetricKindPipelineRetryCount` along with a
+// per-attempt duration so flaky pipelines can be distinguished from one-off failures.
+// It also walks `jobs` (fetched once by the caller) and increments
+// `MetricKindJobRetryCount` by however much each job's retry count grew since the
+// attempt count stored for it in this pipeline.
+func (c *Controller) ProcessPipelineRetryMetrics(ctx context.Context, ref schemas.Ref, previousStatus string, pipeline schemas.Pipeline, jobs []*goGitlab.Job) error {
+	labels := ref.DefaultLabelsValues()
+
+	if slices.Contains(failedStatusesList, previousStatus) && slices.Contains(recoveredStatusesList, pipeline.Status) {
+		retryCount := schemas.Metric{
+			Kind:   schemas.MetricKindPipelineRetryCount,
+			Labels: labels,
+		}
+
+		storeGetMetric(ctx, c.Store, &retryCount)
+		retryCount.Value++
+		storeSetMetric(ctx, c.Store, retryCount)
+
+		storeSetMetric(ctx, c.Store, schemas.Metric{
+			Kind:   schemas.MetricKindPipelineRetryDurationSeconds,
+			Labels: labels,
+			Value:  pipeline.DurationSeconds,
+		})
+
+		emitStatusMetric(
+			ctx,
+			c.Store,
+			schemas.MetricKindStatus,
+			mergeLabels(labels, map[string]string{"retried": "true"}),
+			statusesList[:],
+			pipeline.Status,
+			ref.Project.OutputSparseStatusMetrics,
+		)
+	}
+
+	for _, job := range jobs {
+		jobLabels := mergeLabels(labels, map[string]string{
+			"stage":    job.Stage,
+			"job_name": job.Name,
+		})
+
+		attemptMetric := schemas.Metric{
+			Kind:   schemas.MetricKindJobRetryCount,
+			Labels: jobLabels,
+		}
+
+		// Scope the stored attempt count to this pipeline ID, not just the job name --
+		// otherwise a job name shared across pipelines inherits a leftover attempt count
+		// from a prior pipeline and fresh retries on the new one go uncounted.
+		jobKey := fmt.Sprintf("%d/%s", pipeline.ID, job.Name)
+
+		previousAttempts, _ := c.Store.GetJobAttempts(ctx, ref, jobKey)
+		storeGetMetric(ctx, c.Store, &attemptMetric)
+
+		if job.RetryCount() > previousAttempts {
+			attemptMetric.Value += float64(job.RetryCount() - previousAttempts)
+			storeSetMetric(ctx, c.Store, attemptMetric)
+
+			storeSetMetric(ctx, c.Store, schemas.Metric{
+				Kind:   schemas.MetricKindJobRetryDurationSeconds,
+				Labels: jobLabels,
+				Value:  job.Duration,
+			})
+		}
+
+		c.Store.SetJobAttempts(ctx, ref, jobKey, job.RetryCount())
+	}
+
+	return nil
+}
+
+// mergeLabels returns a copy of `base` with `extra` merged in, without mutating `base`.
+func mergeLabels(base schemas.Labels, extra map[string]string) schemas.Labels {
+	merged := make(schemas.Labels, len(base)+len(extra))
+	for k, v := range base {
+		merged[k] = v
+	}
+
+	for k, v := range extra {
+		merged[k] = v
+	}
+
+	return merged
+}
+
+// ProcessPipelineConfigSourceMetrics resolves where the pipeline's `.gitlab-ci.yml` was
+// actually sourced from -- inline, `include:remote`, `include:project`, `include:template`,
+// or an external `ci_config_path` -- and emits a `MetricKindConfigSourceInfo` info gauge
+// carrying the resolved kind/URI/ref/SHA as labels, so dashboards can flag pipelines
+// running a floating-tag remote include without re-scraping GitLab themselves.
+func (c *Controller) ProcessPipelineConfigSourceMetrics(ctx context.Context, ref schemas.Ref, pipeline schemas.Pipeline, previousConfigSource schemas.ConfigSource) error {
+	configSource, err := c.Gitlab.GetPipelineConfigSource(ctx, ref, pipeline.ID)
+	if err != nil {
+		return err
+	}
+
+	pipeline.ConfigSource = configSource
+	ref.LatestPipeline.ConfigSource = configSource
+
+	if err := c.Store.SetRef(ctx, ref); err != nil {
+		return err
+	}
+
+	// The SHA/URI/ref are carried as labels, so a source change (e.g. a floating tag
+	// resolving to a new SHA) mints a brand new series every time. Drop the previous one
+	// first so cardinality doesn't grow unbounded for busy refs.
+	if previousConfigSource != (schemas.ConfigSource{}) && previousConfigSource != configSource {
+		if err := c.Store.DelMetric(ctx, schemas.Metric{
+			Kind: schemas.MetricKindConfigSourceInfo,
+			Labels: mergeLabels(ref.DefaultLabelsValues(), map[string]string{
+				"config_source_kind": string(previousConfigSource.Kind),
+				"config_source_uri":  previousConfigSource.URI,
+				"config_source_ref":  previousConfigSource.Ref,
+				"config_source_sha":  previousConfigSource.SHA,
+			}),
+		}); err != nil {
+			log.WithContext(ctx).
+				WithFields(log.Fields{
+					"project-name": ref.Project.Name,
+					"ref":          ref.Name,
+				}).
+				WithError(err).
+				Warn("deleting previous pipeline config source metric")
+		}
+	}
+
+	storeSetMetric(ctx, c.Store, schemas.Metric{
+		Kind: schemas.MetricKindConfigSourceInfo,
+		Labels: mergeLabels(ref.DefaultLabelsValues(), map[string]string{
+			"config_source_kind": string(configSource.Kind),
+			"config_source_uri":  configSource.URI,
+			"config_source_ref":  configSource.Ref,
+			"config_source_sha":  configSource.SHA,
+		}),
+		Value: 1,
+	})
+
 	return nil
 }
 
@@ -364,4 +752,98 @@ func (c *Controller) ProcessTestCaseMetrics(ctx context.Context, ref schemas.Ref
 		tc.Status,
 		ref.Project.OutputSparseStatusMetrics,
 	)
+
+	if ref.Project.Pull.Pipeline.TestReports.TestCases.Flakiness.Enabled {
+		c.processTestCaseFlakinessMetrics(ctx, ref, ts, tc, labels)
+	}
+}
+
+// processTestCaseFlakinessMetrics keeps a bounded ring buffer of the last `window`
+// statuses observed for this `(project, ref, test_suite_name, test_case_classname,
+// test_case_name)` in the store, and derives:
+//   - `MetricKindTestCaseFlakinessRatio`: the fraction of status flips across the window
+//   - `MetricKindTestCaseConsecutiveFailures`: the current losing streak
+//   - `MetricKindTestCaseLastTransitionTimestamp`: when the status last flipped
+//
+// so that alerting rules can require "flaky AND recently flipped" rather than just flaky.
+func (c *Controller) processTestCaseFlakinessMetrics(ctx context.Context, ref schemas.Ref, ts schemas.TestSuite, tc schemas.TestCase, labels schemas.Labels) {
+	window := ref.Project.Pull.Pipeline.TestReports.TestCases.Flakiness.Window
+	if window <= 0 {
+		window = schemas.DefaultTestCaseFlakinessWindow
+	}
+
+	history, _ := c.Store.GetTestCaseHistory(ctx, ref, ts.Name, tc.Classname, tc.Name)
+
+	var transitioned bool
+	if len(history) > 0 && history[len(history)-1] != tc.Status {
+		transitioned = true
+	}
+
+	history = append(history, tc.Status)
+	if len(history) > window {
+		history = history[len(history)-window:]
+	}
+
+	// Append only the new status -- AppendTestCaseHistory has append, not replace,
+	// semantics, so handing it the already-windowed slice would duplicate it into the
+	// stored history and grow past `window` on every call. `history` here stays local,
+	// used only to derive the metrics below.
+	if err := c.Store.AppendTestCaseHistory(ctx, ref, ts.Name, tc.Classname, tc.Name, tc.Status, window); err != nil {
+		log.WithContext(ctx).
+			WithFields(log.Fields{
+				"project-name":    ref.Project.Name,
+				"ref":             ref.Name,
+				"test-suite-name": ts.Name,
+				"test-case-name":  tc.Name,
+			}).
+			WithError(err).
+			Error("appending test case history to the store")
+
+		return
+	}
+
+	var flips, consecutiveFailures int
+
+	for i := 1; i < len(history); i++ {
+		if history[i] != history[i-1] {
+			flips++
+		}
+	}
+
+	// A skipped test is not a failed test -- only count genuine failures (and errors,
+	// which are treated the same as a failure) towards the losing streak, and let a
+	// skip break it the same way a success would.
+	failureStatuses := map[string]bool{"failed": true, "error": true}
+
+	for i := len(history) - 1; i >= 0 && failureStatuses[history[i]]; i-- {
+		consecutiveFailures++
+	}
+
+	// flips counts transitions across the adjacent pairs of history, of which there are
+	// len(history)-1 -- dividing by len(history) instead meant the ratio could never reach 1.0
+	// even for a fully-alternating window.
+	var ratio float64
+	if len(history) > 1 {
+		ratio = float64(flips) / float64(len(history)-1)
+	}
+
+	storeSetMetric(ctx, c.Store, schemas.Metric{
+		Kind:   schemas.MetricKindTestCaseFlakinessRatio,
+		Labels: labels,
+		Value:  ratio,
+	})
+
+	storeSetMetric(ctx, c.Store, schemas.Metric{
+		Kind:   schemas.MetricKindTestCaseConsecutiveFailures,
+		Labels: labels,
+		Value:  float64(consecutiveFailures),
+	})
+
+	if transitioned {
+		storeSetMetric(ctx, c.Store, schemas.Metric{
+			Kind:   schemas.MetricKindTestCaseLastTransitionTimestamp,
+			Labels: labels,
+			Value:  float64(time.Now().Unix()),
+		})
+	}
 }